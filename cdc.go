@@ -0,0 +1,327 @@
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// CDC_SIG_MAGIC identifies a signature built from content-defined chunks
+// rather than fixed-size blocks. Unlike a fixed-block signature, an insert
+// or delete near the start of the file only shifts chunk boundaries nearby,
+// so the rest of the file still matches.
+const CDC_SIG_MAGIC MagicNumber = 0x72730150
+
+func init() {
+	RegisterStrongHash(CDC_SIG_MAGIC, "blake2b-256", BLAKE2_SUM_LENGTH, func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	})
+}
+
+// CDCOptions configures the FastCDC chunker used by SignatureCDC.
+type CDCOptions struct {
+	// AvgSize is the target chunk size in bytes.
+	AvgSize uint32
+	// MinSize and MaxSize clamp every chunk to [MinSize, MaxSize], except
+	// that the final chunk of the input may be shorter than MinSize.
+	MinSize uint32
+	MaxSize uint32
+	// GearSeed seeds the GEAR table. Two signatures built with different
+	// seeds will not agree on chunk boundaries for the same input. Zero
+	// selects a fixed default seed.
+	GearSeed uint64
+}
+
+func (o CDCOptions) normalize() CDCOptions {
+	if o.AvgSize == 0 {
+		o.AvgSize = 8 << 10
+	}
+	if o.MinSize == 0 {
+		o.MinSize = o.AvgSize / 4
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = o.AvgSize * 8
+	}
+	if o.GearSeed == 0 {
+		o.GearSeed = 0x72736664 // "rsfd"
+	}
+	return o
+}
+
+// cdcSignatureMeta holds the per-chunk lengths and chunker parameters
+// needed to re-derive a CDC signature's SignatureType from its wire
+// encoding, and to re-emit that encoding via writeCDCSignature.
+type cdcSignatureMeta struct {
+	opts      CDCOptions
+	chunkLens []uint32
+}
+
+// gearTable deterministically derives the 256-entry GEAR table from seed,
+// so that two chunkers built with the same seed make the same cut
+// decisions.
+func gearTable(seed uint64) [256]uint64 {
+	var t [256]uint64
+	rnd := rand.New(rand.NewSource(int64(seed)))
+	for i := range t {
+		t[i] = rnd.Uint64()
+	}
+	return t
+}
+
+func maskWithBits(n int) uint64 {
+	return (uint64(1) << n) - 1
+}
+
+// cdcChunker implements FastCDC's normalized chunking: a cheap rolling hash
+// declares a cut using a stricter 13-bit mask (maskS) before avgSize bytes
+// have accumulated, and a looser 11-bit mask (maskL) after, which clusters
+// cuts around avgSize without the
+// sharp cutoff a single mask would produce.
+type cdcChunker struct {
+	gear    [256]uint64
+	minSize uint32
+	avgSize uint32
+	maxSize uint32
+	maskS   uint64
+	maskL   uint64
+}
+
+func newCDCChunker(opts CDCOptions) *cdcChunker {
+	opts = opts.normalize()
+	return &cdcChunker{
+		gear:    gearTable(opts.GearSeed),
+		minSize: opts.MinSize,
+		avgSize: opts.AvgSize,
+		maxSize: opts.MaxSize,
+		maskS:   maskWithBits(13),
+		maskL:   maskWithBits(11),
+	}
+}
+
+// next reads the next content-defined chunk from r. It returns io.EOF once
+// r is exhausted with no further chunk produced.
+func (c *cdcChunker) next(r io.ByteReader) ([]byte, error) {
+	buf := make([]byte, 0, c.maxSize)
+	var h uint64
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			if len(buf) == 0 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, b)
+		h = (h << 1) + c.gear[b]
+
+		n := uint32(len(buf))
+		if n < c.minSize {
+			continue
+		}
+		if n >= c.maxSize {
+			return buf, nil
+		}
+		if n < c.avgSize {
+			if h&c.maskS == 0 {
+				return buf, nil
+			}
+		} else if h&c.maskL == 0 {
+			return buf, nil
+		}
+	}
+}
+
+// SignatureCDC is the content-defined-chunking counterpart to Signature: it
+// splits input into variable-length chunks using FastCDC and records
+// (length, weak, strong) per chunk instead of relying on a fixed stride.
+// DeltaCDC is its delta-matching counterpart, rescanning a new file with the
+// same FastCDC parameters to rediscover chunk boundaries.
+func SignatureCDC(input io.Reader, output io.Writer, opts CDCOptions, strongLen uint32) (*SignatureType, error) {
+	algo, err := lookupStrongHash(CDC_SIG_MAGIC)
+	if err != nil {
+		return nil, err
+	}
+	if strongLen > algo.maxLen {
+		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, CDC_SIG_MAGIC)
+	}
+
+	opts = opts.normalize()
+
+	if err := binary.Write(output, binary.BigEndian, CDC_SIG_MAGIC); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, opts.AvgSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, opts.MinSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, opts.MaxSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, opts.GearSeed); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, strongLen); err != nil {
+		return nil, err
+	}
+
+	chunker := newCDCChunker(opts)
+	br := bufio.NewReader(input)
+
+	ret := &SignatureType{
+		sigType:    CDC_SIG_MAGIC,
+		blockLen:   opts.AvgSize,
+		strongLen:  strongLen,
+		strongHash: algo,
+		weak2block: map[uint32][]int{},
+		cdc:        &cdcSignatureMeta{opts: opts},
+	}
+
+	for {
+		data, err := chunker.next(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := binary.Write(output, binary.BigEndian, uint32(len(data))); err != nil {
+			return nil, err
+		}
+
+		weak := WeakChecksum(data)
+		if err := binary.Write(output, binary.BigEndian, weak); err != nil {
+			return nil, err
+		}
+
+		strong, err := CalcStrongSum(data, CDC_SIG_MAGIC, strongLen)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := output.Write(strong); err != nil {
+			return nil, err
+		}
+
+		ret.addBlock(weak, strong)
+		ret.cdc.chunkLens = append(ret.cdc.chunkLens, uint32(len(data)))
+	}
+
+	return ret, nil
+}
+
+// readCDCSignature reads a CDC_SIG_MAGIC signature's header and
+// (length, weak, strong) entries. magic has already been consumed by the
+// caller (ReadSignature).
+func readCDCSignature(r io.Reader, magic MagicNumber) (*SignatureType, error) {
+	var opts CDCOptions
+	if err := binary.Read(r, binary.BigEndian, &opts.AvgSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &opts.MinSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &opts.MaxSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &opts.GearSeed); err != nil {
+		return nil, err
+	}
+
+	var strongLen uint32
+	if err := binary.Read(r, binary.BigEndian, &strongLen); err != nil {
+		return nil, err
+	}
+
+	algo, err := lookupStrongHash(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &SignatureType{
+		sigType:    magic,
+		blockLen:   opts.AvgSize,
+		strongLen:  strongLen,
+		strongHash: algo,
+		weak2block: map[uint32][]int{},
+		cdc:        &cdcSignatureMeta{opts: opts},
+	}
+
+	for {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var weak uint32
+		if err := binary.Read(r, binary.BigEndian, &weak); err != nil {
+			return nil, err
+		}
+
+		strong := make([]byte, strongLen)
+		n, err := r.Read(strong)
+		if err != nil {
+			return nil, err
+		}
+		if n != int(strongLen) {
+			return nil, fmt.Errorf("got only %d/%d bytes of the strong hash", n, strongLen)
+		}
+
+		ret.addBlock(weak, strong)
+		ret.cdc.chunkLens = append(ret.cdc.chunkLens, length)
+	}
+
+	return ret, nil
+}
+
+// writeCDCSignature re-emits sig, which must have been built by
+// SignatureCDC or readCDCSignature, in the CDC_SIG_MAGIC wire format.
+func writeCDCSignature(sig *SignatureType, w io.Writer) error {
+	opts := sig.cdc.opts
+
+	if err := binary.Write(w, binary.BigEndian, sig.sigType); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, opts.AvgSize); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, opts.MinSize); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, opts.MaxSize); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, opts.GearSeed); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, sig.strongLen); err != nil {
+		return err
+	}
+
+	for i, strong := range sig.strongSigs {
+		if err := binary.Write(w, binary.BigEndian, sig.cdc.chunkLens[i]); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, sig.weakSums[i]); err != nil {
+			return err
+		}
+		if _, err := w.Write(strong); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSignatureCDCBlockLenConsistentWithReadBack(t *testing.T) {
+	var out bytes.Buffer
+	opts := CDCOptions{AvgSize: 256, MinSize: 64, MaxSize: 1024, GearSeed: 42}
+
+	built, err := SignatureCDC(strings.NewReader(strings.Repeat("abcdefgh", 2000)), &out, opts, BLAKE2_SUM_LENGTH)
+	if err != nil {
+		t.Fatalf("SignatureCDC: %v", err)
+	}
+
+	read, err := ReadSignature(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+
+	if built.BlockLen() != read.BlockLen() {
+		t.Fatalf("BlockLen mismatch between freshly built and read-back CDC signature: %d != %d", built.BlockLen(), read.BlockLen())
+	}
+	if built.BlockLen() != opts.AvgSize {
+		t.Fatalf("BlockLen() = %d, want AvgSize %d", built.BlockLen(), opts.AvgSize)
+	}
+}
+
+func TestSignatureCDCRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	opts := CDCOptions{AvgSize: 128, MinSize: 32, MaxSize: 512, GearSeed: 7}
+
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog. ", 500)
+	built, err := SignatureCDC(strings.NewReader(content), &out, opts, BLAKE2_SUM_LENGTH)
+	if err != nil {
+		t.Fatalf("SignatureCDC: %v", err)
+	}
+	if len(built.strongSigs) == 0 {
+		t.Fatal("expected at least one chunk")
+	}
+
+	read, err := ReadSignature(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+	if len(read.strongSigs) != len(built.strongSigs) {
+		t.Fatalf("chunk count mismatch: got %d, want %d", len(read.strongSigs), len(built.strongSigs))
+	}
+	for i := range built.strongSigs {
+		if !bytes.Equal(read.strongSigs[i], built.strongSigs[i]) {
+			t.Fatalf("chunk %d strong sum mismatch", i)
+		}
+		if read.weakSums[i] != built.weakSums[i] {
+			t.Fatalf("chunk %d weak sum mismatch", i)
+		}
+	}
+
+	// The signature must also be re-serializable byte for byte via
+	// writeSignature, e.g. for SignSignature.
+	var reemitted bytes.Buffer
+	if _, err := writeSignature(read, &reemitted); err != nil {
+		t.Fatalf("writeSignature: %v", err)
+	}
+	if !bytes.Equal(reemitted.Bytes(), out.Bytes()) {
+		t.Fatal("writeSignature did not reproduce the original CDC wire encoding")
+	}
+}
+
+func TestCDCChunkerDeterministic(t *testing.T) {
+	opts := CDCOptions{AvgSize: 64, MinSize: 16, MaxSize: 256, GearSeed: 99}
+	data := []byte(strings.Repeat("0123456789", 1000))
+
+	chunk := func() [][]byte {
+		c := newCDCChunker(opts)
+		br := byteSliceReader(data)
+		var chunks [][]byte
+		for {
+			d, err := c.next(&br)
+			if err != nil {
+				break
+			}
+			cp := append([]byte(nil), d...)
+			chunks = append(chunks, cp)
+		}
+		return chunks
+	}
+
+	a := chunk()
+	b := chunk()
+	if len(a) != len(b) {
+		t.Fatalf("chunk count not deterministic: %d vs %d", len(a), len(b))
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			t.Fatalf("chunk %d differs between runs", i)
+		}
+	}
+}
+
+// byteSliceReader is a minimal io.ByteReader over a byte slice, used to
+// drive cdcChunker in tests without pulling in bufio.
+type byteSliceReader []byte
+
+func (b *byteSliceReader) ReadByte() (byte, error) {
+	if len(*b) == 0 {
+		return 0, io.EOF
+	}
+	c := (*b)[0]
+	*b = (*b)[1:]
+	return c, nil
+}
@@ -0,0 +1,196 @@
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Delta opcodes identify entries in the byte stream Delta and DeltaCDC
+// write: opCopy references a run of bytes already present in the basis file
+// indexed by the signature, opLiteral carries bytes that were not found
+// there, and opEnd terminates the stream. SignDelta/VerifyDeltaReader treat
+// this stream as opaque payload bytes to hash and sign, not to interpret.
+const (
+	opEnd     byte = 0x00
+	opLiteral byte = 0x01
+	opCopy    byte = 0x02
+)
+
+// deltaWriter accumulates literal bytes until a copy is emitted or the
+// stream ends, so that adjacent unmatched bytes are written as one
+// opLiteral instead of one per byte.
+type deltaWriter struct {
+	w       io.Writer
+	literal []byte
+}
+
+func (d *deltaWriter) addLiteral(b byte) {
+	d.literal = append(d.literal, b)
+}
+
+func (d *deltaWriter) addLiteralBytes(p []byte) {
+	d.literal = append(d.literal, p...)
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	if err := binary.Write(d.w, binary.BigEndian, opLiteral); err != nil {
+		return err
+	}
+	if err := binary.Write(d.w, binary.BigEndian, uint32(len(d.literal))); err != nil {
+		return err
+	}
+	if _, err := d.w.Write(d.literal); err != nil {
+		return err
+	}
+	d.literal = d.literal[:0]
+	return nil
+}
+
+func (d *deltaWriter) writeCopy(offset, length int64) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	if err := binary.Write(d.w, binary.BigEndian, opCopy); err != nil {
+		return err
+	}
+	if err := binary.Write(d.w, binary.BigEndian, uint64(offset)); err != nil {
+		return err
+	}
+	return binary.Write(d.w, binary.BigEndian, uint64(length))
+}
+
+func (d *deltaWriter) writeEnd() error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	return binary.Write(d.w, binary.BigEndian, opEnd)
+}
+
+// Delta compares newFile against the fixed-block basis signature indexed by
+// sig and writes an rdiff delta to out: a run of bytes found in the basis
+// becomes an opCopy referencing that basis offset and length, and
+// everything else becomes opLiteral. It works against the SignatureIndex
+// interface alone, so it runs the same way whether sig is the in-memory
+// SignatureType or a disk-backed index from ReadSignatureIndexed, and
+// resolves a weak-sum collision exactly as sig.Lookup defines it.
+//
+// A byte-by-byte search is used rather than an incremental rolling
+// checksum: WeakChecksum is recomputed over each candidate window, which
+// costs O(len(newFile)*BlockLen) instead of the O(len(newFile)) a true
+// rolling update would give, but needs nothing beyond the already-exported
+// checksum. sig must not be a CDC_SIG_MAGIC signature; use DeltaCDC for
+// those.
+func Delta(newFile io.Reader, sig SignatureIndex, out io.Writer) error {
+	if sig.SigType() == CDC_SIG_MAGIC {
+		return fmt.Errorf("Delta: sigType %#x uses variable-length chunks; use DeltaCDC instead", sig.SigType())
+	}
+	algo, err := lookupStrongHash(sig.SigType())
+	if err != nil {
+		return err
+	}
+
+	blockLen := int(sig.BlockLen())
+	if blockLen <= 0 {
+		return fmt.Errorf("Delta: invalid BlockLen %d", blockLen)
+	}
+	strongLen := sig.StrongLen()
+	salt := sig.Salt()
+
+	br := bufio.NewReaderSize(newFile, blockLen+32*1024)
+	dw := &deltaWriter{w: out}
+
+	for {
+		window, peekErr := br.Peek(blockLen)
+		if len(window) == 0 {
+			if peekErr != nil && peekErr != io.EOF {
+				return peekErr
+			}
+			break
+		}
+
+		weak := WeakChecksum(window)
+		strong, err := calcStrongSum(window, algo, strongLen, salt)
+		if err != nil {
+			return err
+		}
+
+		if block, ok := sig.Lookup(weak, strong); ok {
+			if err := dw.writeCopy(int64(block)*int64(blockLen), int64(len(window))); err != nil {
+				return err
+			}
+			if _, err := br.Discard(len(window)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		dw.addLiteral(b)
+	}
+
+	return dw.writeEnd()
+}
+
+// DeltaCDC is the content-defined-chunking counterpart to Delta: it rescans
+// newFile with the same FastCDC parameters sig was built with, so that an
+// insert or delete elsewhere in the file only disturbs the chunk boundaries
+// near it rather than desynchronizing every chunk after that point. sig
+// must have been built by SignatureCDC or read back from a CDC_SIG_MAGIC
+// signature; it is used directly rather than through SignatureIndex because
+// ReadSignatureIndexed refuses to build a disk-backed index over
+// variable-length chunks.
+func DeltaCDC(newFile io.Reader, sig *SignatureType, out io.Writer) error {
+	if sig.cdc == nil {
+		return fmt.Errorf("DeltaCDC: sigType %#x is not a CDC signature", sig.sigType)
+	}
+	algo, err := lookupStrongHash(sig.sigType)
+	if err != nil {
+		return err
+	}
+
+	chunker := newCDCChunker(sig.cdc.opts)
+	br := bufio.NewReader(newFile)
+	dw := &deltaWriter{w: out}
+
+	offset := int64(0)
+	offsets := make([]int64, len(sig.cdc.chunkLens)+1)
+	for i, l := range sig.cdc.chunkLens {
+		offsets[i] = offset
+		offset += int64(l)
+	}
+	offsets[len(sig.cdc.chunkLens)] = offset
+
+	for {
+		data, err := chunker.next(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		weak := WeakChecksum(data)
+		strong, err := calcStrongSum(data, algo, sig.strongLen, sig.salt)
+		if err != nil {
+			return err
+		}
+
+		if block, ok := sig.Lookup(weak, strong); ok {
+			if err := dw.writeCopy(offsets[block], int64(len(data))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dw.addLiteralBytes(data)
+	}
+
+	return dw.writeEnd()
+}
@@ -0,0 +1,204 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// applyDeltaForTest replays the op stream Delta produces against basis,
+// reconstructing the bytes it describes. It exists only to verify Delta's
+// output in tests; the package has no patch-application API.
+func applyDeltaForTest(t *testing.T, delta, basis []byte) []byte {
+	t.Helper()
+	r := bytes.NewReader(delta)
+	var out bytes.Buffer
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("reading opcode: %v", err)
+		}
+		switch op {
+		case opEnd:
+			return out.Bytes()
+		case opLiteral:
+			var n uint32
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				t.Fatalf("reading literal length: %v", err)
+			}
+			if _, err := io.CopyN(&out, r, int64(n)); err != nil {
+				t.Fatalf("reading literal bytes: %v", err)
+			}
+		case opCopy:
+			var offset, length uint64
+			if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+				t.Fatalf("reading copy offset: %v", err)
+			}
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				t.Fatalf("reading copy length: %v", err)
+			}
+			if offset+length > uint64(len(basis)) {
+				t.Fatalf("copy [%d,%d) out of range of %d-byte basis", offset, offset+length, len(basis))
+			}
+			out.Write(basis[offset : offset+length])
+		default:
+			t.Fatalf("unknown delta opcode %#x", op)
+		}
+	}
+}
+
+func TestDeltaRoundTripUnchanged(t *testing.T) {
+	basis := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 50))
+
+	var sigBytes bytes.Buffer
+	sig, err := Signature(bytes.NewReader(basis), &sigBytes, 16, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("Signature: %v", err)
+	}
+
+	var deltaBytes bytes.Buffer
+	if err := Delta(bytes.NewReader(basis), sig, &deltaBytes); err != nil {
+		t.Fatalf("Delta: %v", err)
+	}
+
+	got := applyDeltaForTest(t, deltaBytes.Bytes(), basis)
+	if !bytes.Equal(got, basis) {
+		t.Fatalf("round-tripped delta mismatch: got %d bytes, want %d bytes", len(got), len(basis))
+	}
+}
+
+func TestDeltaRoundTripWithInsertAndEdit(t *testing.T) {
+	basis := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 50))
+
+	var sigBytes bytes.Buffer
+	sig, err := Signature(bytes.NewReader(basis), &sigBytes, 16, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("Signature: %v", err)
+	}
+
+	newContent := append([]byte(nil), basis[:100]...)
+	newContent = append(newContent, []byte("-- an inserted sentence that is not in the basis at all --")...)
+	newContent = append(newContent, basis[100:]...)
+
+	var deltaBytes bytes.Buffer
+	if err := Delta(bytes.NewReader(newContent), sig, &deltaBytes); err != nil {
+		t.Fatalf("Delta: %v", err)
+	}
+
+	got := applyDeltaForTest(t, deltaBytes.Bytes(), basis)
+	if !bytes.Equal(got, newContent) {
+		t.Fatalf("round-tripped delta mismatch:\n got  %q\n want %q", got, newContent)
+	}
+}
+
+func TestDeltaUsesDiskBackedIndex(t *testing.T) {
+	basis := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 50))
+
+	path := writeTempSignature(t, func(out *os.File) error {
+		_, err := Signature(bytes.NewReader(basis), out, 16, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+		return err
+	})
+
+	idx, err := ReadSignatureIndexed(path, IndexOptions{MaxRAM: 1})
+	if err != nil {
+		t.Fatalf("ReadSignatureIndexed: %v", err)
+	}
+	defer idx.Close()
+
+	newContent := append(append([]byte(nil), basis[:50]...), basis[100:]...)
+
+	var deltaBytes bytes.Buffer
+	if err := Delta(bytes.NewReader(newContent), idx, &deltaBytes); err != nil {
+		t.Fatalf("Delta: %v", err)
+	}
+
+	got := applyDeltaForTest(t, deltaBytes.Bytes(), basis)
+	if !bytes.Equal(got, newContent) {
+		t.Fatalf("round-tripped delta mismatch against disk-backed index:\n got  %q\n want %q", got, newContent)
+	}
+}
+
+func TestDeltaRejectsCDCSignature(t *testing.T) {
+	var sigBytes bytes.Buffer
+	sig, err := SignatureCDC(strings.NewReader(strings.Repeat("abcdefgh", 200)), &sigBytes, CDCOptions{AvgSize: 32, MinSize: 8, MaxSize: 128}, BLAKE2_SUM_LENGTH)
+	if err != nil {
+		t.Fatalf("SignatureCDC: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Delta(strings.NewReader("abcdefgh"), sig, &out); err == nil {
+		t.Fatal("Delta should reject a CDC_SIG_MAGIC signature")
+	}
+}
+
+func TestDeltaThreadsSalt(t *testing.T) {
+	basis := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 50))
+
+	var sigBytes bytes.Buffer
+	sig, err := SignatureWithOptions(bytes.NewReader(basis), &sigBytes, 16, BLAKE2_SUM_LENGTH, BLAKE2_KEYED_SIG_MAGIC, SignatureOptions{GenerateSalt: true})
+	if err != nil {
+		t.Fatalf("SignatureWithOptions: %v", err)
+	}
+
+	newContent := append(append([]byte(nil), basis[:50]...), basis[100:]...)
+
+	var deltaBytes bytes.Buffer
+	if err := Delta(bytes.NewReader(newContent), sig, &deltaBytes); err != nil {
+		t.Fatalf("Delta: %v", err)
+	}
+
+	got := applyDeltaForTest(t, deltaBytes.Bytes(), basis)
+	if !bytes.Equal(got, newContent) {
+		t.Fatalf("round-tripped salted delta mismatch:\n got  %q\n want %q", got, newContent)
+	}
+}
+
+func TestSignatureWithOptionsRejectsWrongSaltLength(t *testing.T) {
+	var out bytes.Buffer
+	_, err := SignatureWithOptions(strings.NewReader("basis"), &out, 16, BLAKE2_SUM_LENGTH, BLAKE2_KEYED_SIG_MAGIC, SignatureOptions{Salt: []byte{1, 2, 3, 4}})
+	if err == nil {
+		t.Fatal("SignatureWithOptions should reject a salt whose length isn't SaltLength")
+	}
+}
+
+func TestDeltaCDCRoundTrip(t *testing.T) {
+	opts := CDCOptions{AvgSize: 64, MinSize: 16, MaxSize: 256, GearSeed: 99}
+	basis := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 200))
+
+	var sigBytes bytes.Buffer
+	sig, err := SignatureCDC(bytes.NewReader(basis), &sigBytes, opts, BLAKE2_SUM_LENGTH)
+	if err != nil {
+		t.Fatalf("SignatureCDC: %v", err)
+	}
+
+	newContent := append([]byte(nil), basis[:500]...)
+	newContent = append(newContent, []byte("-- an inserted paragraph that is nowhere in the basis --")...)
+	newContent = append(newContent, basis[500:]...)
+
+	var deltaBytes bytes.Buffer
+	if err := DeltaCDC(bytes.NewReader(newContent), sig, &deltaBytes); err != nil {
+		t.Fatalf("DeltaCDC: %v", err)
+	}
+
+	got := applyDeltaForTest(t, deltaBytes.Bytes(), basis)
+	if !bytes.Equal(got, newContent) {
+		t.Fatalf("round-tripped CDC delta mismatch:\n got  %q\n want %q", got, newContent)
+	}
+}
+
+func TestDeltaCDCRejectsFixedBlockSignature(t *testing.T) {
+	var sigBytes bytes.Buffer
+	sig, err := Signature(strings.NewReader("basis content"), &sigBytes, 16, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("Signature: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := DeltaCDC(strings.NewReader("basis content"), sig, &out); err == nil {
+		t.Fatal("DeltaCDC should reject a non-CDC signature")
+	}
+}
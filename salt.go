@@ -0,0 +1,128 @@
+package librsync
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// BLAKE2_KEYED_SIG_MAGIC identifies a signature whose strong sums are a
+// BLAKE2b MAC keyed with a per-signature salt, rather than a plain BLAKE2b
+// hash. An attacker able to influence the basis file cannot engineer a
+// strong-sum collision without also knowing the salt, which closes the
+// truncated-hash collision attack that BLAKE2_SIG_MAGIC and MD4_SIG_MAGIC
+// are vulnerable to. It deliberately uses a distinct magic number so a
+// salted signature can never be misread as, or downgraded to, an unsalted
+// one.
+const BLAKE2_KEYED_SIG_MAGIC MagicNumber = 0x72730160
+
+// SaltLength is the size, in bytes, of the salt used to key
+// BLAKE2_KEYED_SIG_MAGIC.
+const SaltLength = 16
+
+func init() {
+	RegisterKeyedStrongHash(BLAKE2_KEYED_SIG_MAGIC, "blake2b-256-keyed", BLAKE2_SUM_LENGTH, func(key []byte) (hash.Hash, error) {
+		return blake2b.New(BLAKE2_SUM_LENGTH, key)
+	})
+}
+
+// SignatureOptions configures SignatureWithOptions.
+type SignatureOptions struct {
+	// Salt keys a keyed strong hash such as BLAKE2_KEYED_SIG_MAGIC. A
+	// non-empty Salt with an unkeyed sigType is rejected with an error.
+	Salt []byte
+
+	// GenerateSalt, if true and Salt is empty, generates a random
+	// SaltLength-byte salt for a keyed sigType.
+	GenerateSalt bool
+}
+
+// SignatureWithOptions is Signature with the addition of opts, which is
+// required to use a keyed sigType such as BLAKE2_KEYED_SIG_MAGIC. The
+// resulting SignatureType's salt (and a SignatureIndex built over it, via
+// SigType and Salt) is threaded through by Delta when it recomputes a
+// candidate block's strong sum.
+func SignatureWithOptions(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber, opts SignatureOptions) (*SignatureType, error) {
+	algo, err := lookupStrongHash(sigType)
+	if err != nil {
+		return nil, err
+	}
+	if strongLen > algo.maxLen {
+		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, sigType)
+	}
+
+	salt := opts.Salt
+	if algo.newKeyedFn != nil {
+		if len(salt) == 0 && opts.GenerateSalt {
+			salt = make([]byte, SaltLength)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+		}
+		if len(salt) == 0 {
+			return nil, fmt.Errorf("sigType %#x requires a salt", sigType)
+		}
+		if len(salt) != SaltLength {
+			return nil, fmt.Errorf("invalid salt length %d for sigType %#x, want %d", len(salt), sigType, SaltLength)
+		}
+	} else if len(salt) != 0 {
+		return nil, fmt.Errorf("sigType %#x does not support a salt", sigType)
+	}
+
+	if err := binary.Write(output, binary.BigEndian, sigType); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, blockLen); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(output, binary.BigEndian, strongLen); err != nil {
+		return nil, err
+	}
+	if salt != nil {
+		if _, err := output.Write(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	block := make([]byte, blockLen)
+
+	ret := &SignatureType{
+		sigType:    sigType,
+		blockLen:   blockLen,
+		strongLen:  strongLen,
+		strongHash: algo,
+		weak2block: map[uint32][]int{},
+		salt:       salt,
+	}
+
+	for {
+		n, err := input.Read(block)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data := block[:n]
+
+		weak := WeakChecksum(data)
+		if err := binary.Write(output, binary.BigEndian, weak); err != nil {
+			return nil, err
+		}
+
+		strong, err := calcStrongSum(data, algo, strongLen, salt)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := output.Write(strong); err != nil {
+			return nil, err
+		}
+
+		ret.addBlock(weak, strong)
+	}
+
+	return ret, nil
+}
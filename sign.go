@@ -0,0 +1,227 @@
+package librsync
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// signTrailerMagic identifies the trailer appended by SignSignature and
+// SignDelta so VerifySignatureReader/VerifyDeltaReader can recognize it.
+const signTrailerMagic uint32 = 0x72736967 // "rsig"
+
+// trailerLen is the fixed size of the trailer: a magic, a key-id, and an
+// Ed25519 signature.
+const trailerLen = 4 + 8 + ed25519.SignatureSize
+
+// ed25519phOptions selects the prehashed Ed25519ph variant (RFC 8032), so
+// that signing and verification can hash the payload incrementally as it
+// streams through instead of requiring it all in memory at once.
+var ed25519phOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// ErrBadSignature is returned by VerifySignatureReader and VerifyDeltaReader
+// when the trailing Ed25519 signature does not verify against the streamed
+// payload.
+var ErrBadSignature = errors.New("librsync: bad detached signature")
+
+// KeyLookup resolves a key-id, as embedded in a detached-signature trailer,
+// to the Ed25519 public key that should be used to verify it.
+type KeyLookup func(keyID [8]byte) ed25519.PublicKey
+
+func keyIDFor(pub ed25519.PublicKey) [8]byte {
+	var id [8]byte
+	sum := sha256.Sum256(pub)
+	copy(id[:], sum[:8])
+	return id
+}
+
+// hashingWriter forwards writes to w while feeding the same bytes to h, so
+// a payload can be hashed as it is produced rather than buffered first.
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	if n > 0 {
+		hw.h.Write(p[:n])
+	}
+	return n, err
+}
+
+// appendTrailer appends a trailer to out containing a fixed magic, the
+// key-id of priv's public key, and an Ed25519ph signature over the SHA-512
+// prehash accumulated in h of everything written to out so far.
+func appendTrailer(h hash.Hash, out io.Writer, priv ed25519.PrivateKey) error {
+	keyID := keyIDFor(priv.Public().(ed25519.PublicKey))
+	sig, err := priv.Sign(nil, h.Sum(nil), ed25519phOptions)
+	if err != nil {
+		return err
+	}
+
+	var trailer bytes.Buffer
+	if err := binary.Write(&trailer, binary.BigEndian, signTrailerMagic); err != nil {
+		return err
+	}
+	trailer.Write(keyID[:])
+	trailer.Write(sig)
+
+	_, err = out.Write(trailer.Bytes())
+	return err
+}
+
+// SignSignature writes sig followed by a trailer containing an Ed25519
+// signature over it, so a consumer can verify the signature file came from
+// the holder of priv before trusting it. sig is hashed as it is serialized,
+// so this does not buffer the whole signature in memory.
+func SignSignature(sig *SignatureType, priv ed25519.PrivateKey, out io.Writer) error {
+	hw := &hashingWriter{w: out, h: sha512.New()}
+	if _, err := writeSignature(sig, hw); err != nil {
+		return err
+	}
+	return appendTrailer(hw.h, out, priv)
+}
+
+// SignDelta copies the rdiff delta read from in to out, followed by a
+// trailer containing an Ed25519 signature over the bytes copied. The delta
+// is hashed as it is copied, so this does not buffer it in memory.
+func SignDelta(in io.Reader, priv ed25519.PrivateKey, out io.Writer) error {
+	hw := &hashingWriter{w: out, h: sha512.New()}
+	if _, err := io.Copy(hw, in); err != nil {
+		return err
+	}
+	return appendTrailer(hw.h, out, priv)
+}
+
+// trailerVerifyingReader streams r to its caller while hashing the bytes as
+// they pass through, holding back only the final trailerLen bytes. Once r
+// is exhausted, those held-back bytes are checked as the trailer and, if
+// they verify, Read returns io.EOF; otherwise it returns ErrBadSignature.
+// This lets VerifySignatureReader and VerifyDeltaReader authenticate a
+// payload of arbitrary size without buffering it.
+type trailerVerifyingReader struct {
+	r    io.Reader
+	keys KeyLookup
+	hash hash.Hash
+	pend []byte
+	eof  bool
+	err  error
+}
+
+func newTrailerVerifyingReader(r io.Reader, keys KeyLookup) *trailerVerifyingReader {
+	return &trailerVerifyingReader{r: r, keys: keys, hash: sha512.New()}
+}
+
+func (v *trailerVerifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	total := 0
+	for total < len(p) {
+		for len(v.pend) <= trailerLen && !v.eof {
+			buf := make([]byte, 32*1024)
+			n, err := v.r.Read(buf)
+			if n > 0 {
+				v.pend = append(v.pend, buf[:n]...)
+			}
+			if err == io.EOF {
+				v.eof = true
+			} else if err != nil {
+				v.err = err
+				if total > 0 {
+					return total, nil
+				}
+				return 0, err
+			}
+		}
+
+		if len(v.pend) > trailerLen {
+			emit := len(v.pend) - trailerLen
+			if remain := len(p) - total; emit > remain {
+				emit = remain
+			}
+			n := copy(p[total:], v.pend[:emit])
+			v.hash.Write(p[total : total+n])
+			v.pend = v.pend[n:]
+			total += n
+			continue
+		}
+
+		// r is exhausted and at most trailerLen bytes remain: that's the
+		// trailer, or the stream was too short to hold one.
+		if len(v.pend) < trailerLen {
+			v.err = ErrBadSignature
+		} else if err := v.verify(v.pend); err != nil {
+			v.err = err
+		} else {
+			v.err = io.EOF
+		}
+		break
+	}
+
+	if total > 0 {
+		return total, nil
+	}
+	return 0, v.err
+}
+
+func (v *trailerVerifyingReader) verify(trailer []byte) error {
+	magic := binary.BigEndian.Uint32(trailer[:4])
+	if magic != signTrailerMagic {
+		return ErrBadSignature
+	}
+
+	var keyID [8]byte
+	copy(keyID[:], trailer[4:12])
+	sig := trailer[12:]
+
+	pub := v.keys(keyID)
+	if pub == nil {
+		return ErrBadSignature
+	}
+	if err := ed25519.VerifyWithOptions(pub, v.hash.Sum(nil), sig, ed25519phOptions); err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// VerifySignatureReader verifies the detached Ed25519 trailer appended by
+// SignSignature, using keys to resolve the embedded key-id to a public key,
+// and returns the enclosed signature on success. The signature file is
+// streamed and hashed incrementally, never held in memory in full.
+//
+// ReadSignature parses some header fields (magic, blockLen, strongLen)
+// eagerly and can return a raw format error on tampered input before the
+// stream has been read to EOF, which is what triggers trailer verification.
+// In that case the rest of the stream is drained to force that check: if
+// the trailer fails to verify, ErrBadSignature takes precedence over the
+// parse error, since the stream cannot yet be trusted to explain its own
+// corruption.
+func VerifySignatureReader(r io.Reader, keys KeyLookup) (*SignatureType, error) {
+	tvr := newTrailerVerifyingReader(r, keys)
+	sig, err := ReadSignature(tvr)
+	if err != nil {
+		if _, drainErr := io.Copy(io.Discard, tvr); drainErr == ErrBadSignature {
+			return nil, ErrBadSignature
+		}
+		return nil, err
+	}
+	return sig, nil
+}
+
+// VerifyDeltaReader verifies the detached Ed25519 trailer appended by
+// SignDelta, using keys to resolve the embedded key-id to a public key, and
+// returns a reader over the enclosed delta bytes on success. The returned
+// reader only yields bytes once they are known not to be part of the
+// trailer, and the trailer itself is checked once r is exhausted.
+func VerifyDeltaReader(r io.Reader, keys KeyLookup) (io.Reader, error) {
+	return newTrailerVerifyingReader(r, keys), nil
+}
@@ -0,0 +1,116 @@
+package librsync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"strings"
+	"testing"
+)
+
+func lookupFor(pub ed25519.PublicKey) KeyLookup {
+	id := keyIDFor(pub)
+	return func(keyID [8]byte) ed25519.PublicKey {
+		if keyID != id {
+			return nil
+		}
+		return pub
+	}
+}
+
+func TestSignSignatureRoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	var sigBytes bytes.Buffer
+	sig, err := Signature(strings.NewReader(strings.Repeat("hello world ", 1000)), &sigBytes, 64, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("Signature: %v", err)
+	}
+
+	var signed bytes.Buffer
+	if err := SignSignature(sig, priv, &signed); err != nil {
+		t.Fatalf("SignSignature: %v", err)
+	}
+
+	got, err := VerifySignatureReader(&signed, lookupFor(pub))
+	if err != nil {
+		t.Fatalf("VerifySignatureReader: %v", err)
+	}
+	if got.blockLen != sig.blockLen || len(got.strongSigs) != len(sig.strongSigs) {
+		t.Fatalf("round-tripped signature mismatch: got %+v, want %+v", got, sig)
+	}
+}
+
+func TestSignSignatureRejectsTampering(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	var sigBytes bytes.Buffer
+	sig, err := Signature(strings.NewReader("some basis content"), &sigBytes, 16, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("Signature: %v", err)
+	}
+
+	var signed bytes.Buffer
+	if err := SignSignature(sig, priv, &signed); err != nil {
+		t.Fatalf("SignSignature: %v", err)
+	}
+
+	tampered := signed.Bytes()
+	tampered[0] ^= 0xff
+
+	if _, err := VerifySignatureReader(bytes.NewReader(tampered), lookupFor(pub)); err != ErrBadSignature {
+		t.Fatalf("VerifySignatureReader on tampered input: got %v, want ErrBadSignature", err)
+	}
+}
+
+func TestSignDeltaRoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	delta := []byte(strings.Repeat("some delta bytes\n", 5000))
+
+	var signed bytes.Buffer
+	if err := SignDelta(bytes.NewReader(delta), priv, &signed); err != nil {
+		t.Fatalf("SignDelta: %v", err)
+	}
+
+	r, err := VerifyDeltaReader(&signed, lookupFor(pub))
+	if err != nil {
+		t.Fatalf("VerifyDeltaReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading verified delta: %v", err)
+	}
+	if !bytes.Equal(got, delta) {
+		t.Fatalf("verified delta mismatch: got %d bytes, want %d bytes", len(got), len(delta))
+	}
+}
+
+func TestSignDeltaRejectsUnknownKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	var signed bytes.Buffer
+	if err := SignDelta(strings.NewReader("payload"), priv, &signed); err != nil {
+		t.Fatalf("SignDelta: %v", err)
+	}
+
+	r, err := VerifyDeltaReader(&signed, func([8]byte) ed25519.PublicKey { return nil })
+	if err != nil {
+		t.Fatalf("VerifyDeltaReader: %v", err)
+	}
+	if _, err := io.ReadAll(r); err != ErrBadSignature {
+		t.Fatalf("reading with unknown key: got %v, want ErrBadSignature", err)
+	}
+}
@@ -1,13 +1,11 @@
 package librsync
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
-
-	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/md4"
 )
 
 const (
@@ -19,107 +17,145 @@ type SignatureType struct {
 	sigType    MagicNumber
 	blockLen   uint32
 	strongLen  uint32
+	strongHash strongHashAlgo
+	weakSums   []uint32
 	strongSigs [][]byte
-	weak2block map[uint32]int
-}
 
-func CalcStrongSum(data []byte, sigType MagicNumber, strongLen uint32) ([]byte, error) {
-	switch sigType {
-	case BLAKE2_SIG_MAGIC:
-		d := blake2b.Sum256(data)
-		return d[:strongLen], nil
-	case MD4_SIG_MAGIC:
-		d := md4.New()
-		d.Write(data)
-		return d.Sum(nil)[:strongLen], nil
-	}
-	return nil, fmt.Errorf("Invalid sigType %#x", sigType)
+	// weak2block maps a weak sum to every block index sharing it, in the
+	// order they were added. Lookup walks the chain and checks the strong
+	// sum to disambiguate a weak-sum collision between distinct blocks.
+	weak2block map[uint32][]int
+
+	// cdc holds the chunk lengths and FastCDC parameters for a signature
+	// built with CDC_SIG_MAGIC, and is nil for a fixed-block signature.
+	cdc *cdcSignatureMeta
+
+	// salt is the per-signature key used with a keyed strong hash such as
+	// BLAKE2_KEYED_SIG_MAGIC, and is nil for an unsalted signature.
+	salt []byte
 }
 
-func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
-	var maxStrongLen uint32
+// writeSignature serializes sig in the rdiff signature wire format used by
+// Signature, so that a SignatureType built in memory (e.g. by ReadSignature)
+// can be re-emitted byte-for-byte.
+func writeSignature(sig *SignatureType, w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
 
-	switch sigType {
-	case BLAKE2_SIG_MAGIC:
-		maxStrongLen = BLAKE2_SUM_LENGTH
-	case MD4_SIG_MAGIC:
-		maxStrongLen = MD4_SUM_LENGTH
-	default:
-		return nil, fmt.Errorf("invalid sigType %#x", sigType)
+	if sig.cdc != nil {
+		err := writeCDCSignature(sig, counter)
+		return counter.n, err
 	}
 
-	if strongLen > maxStrongLen {
-		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, sigType)
+	if err := binary.Write(counter, binary.BigEndian, sig.sigType); err != nil {
+		return counter.n, err
 	}
-
-	err := binary.Write(output, binary.BigEndian, sigType)
-	if err != nil {
-		return nil, err
+	if err := binary.Write(counter, binary.BigEndian, sig.blockLen); err != nil {
+		return counter.n, err
 	}
-	err = binary.Write(output, binary.BigEndian, blockLen)
-	if err != nil {
-		return nil, err
+	if err := binary.Write(counter, binary.BigEndian, sig.strongLen); err != nil {
+		return counter.n, err
 	}
-	err = binary.Write(output, binary.BigEndian, strongLen)
-	if err != nil {
-		return nil, err
+	if sig.salt != nil {
+		if _, err := counter.Write(sig.salt); err != nil {
+			return counter.n, err
+		}
 	}
 
-	block := make([]byte, blockLen)
+	for i, strong := range sig.strongSigs {
+		if err := binary.Write(counter, binary.BigEndian, sig.weakSums[i]); err != nil {
+			return counter.n, err
+		}
+		if _, err := counter.Write(strong); err != nil {
+			return counter.n, err
+		}
+	}
 
-	var ret SignatureType
-	ret.weak2block = make(map[uint32]int)
-	ret.sigType = sigType
-	ret.strongLen = strongLen
-	ret.blockLen = blockLen
+	return counter.n, nil
+}
 
-	for {
-		n, err := input.Read(block)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		data := block[:n]
+// countingWriter wraps an io.Writer to track the number of bytes written
+// through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-		weak := WeakChecksum(data)
-		err = binary.Write(output, binary.BigEndian, weak)
-		if err != nil {
-			return nil, err
-		}
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
 
-		strong, _ := CalcStrongSum(data, sigType, strongLen)
-		output.Write(strong)
+// Signature builds an unsalted signature. It is equivalent to
+// SignatureWithOptions with a zero SignatureOptions, and therefore rejects
+// a keyed sigType such as BLAKE2_KEYED_SIG_MAGIC.
+func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
+	return SignatureWithOptions(input, output, blockLen, strongLen, sigType, SignatureOptions{})
+}
 
-		ret.weak2block[weak] = len(ret.strongSigs)
-		ret.strongSigs = append(ret.strongSigs, strong)
-	}
+// signatureHeader is the fixed-size prefix of a fixed-block signature: the
+// strong-hash algorithm, the block size, and the (possibly truncated)
+// strong sum length. A CDC_SIG_MAGIC signature lays out its header
+// differently after the magic.
+type signatureHeader struct {
+	magic     MagicNumber
+	blockLen  uint32
+	strongLen uint32
+}
 
-	return &ret, nil
+// readSignatureHeader reads and decodes a signatureHeader from r, leaving r
+// positioned just after the strong sum length: at the salt for a keyed
+// sigType, otherwise at the start of the first (weak, strong) entry.
+func readSignatureHeader(r io.Reader) (signatureHeader, error) {
+	var h signatureHeader
+	if err := binary.Read(r, binary.BigEndian, &h.magic); err != nil {
+		return h, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &h.blockLen); err != nil {
+		return h, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &h.strongLen); err != nil {
+		return h, err
+	}
+	return h, nil
 }
 
 // ReadSignature reads a signature from an io.Reader.
 func ReadSignature(r io.Reader) (*SignatureType, error) {
 	var magic MagicNumber
-	err := binary.Read(r, binary.BigEndian, &magic)
-	if err != nil {
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
 		return nil, err
 	}
 
+	if magic == CDC_SIG_MAGIC {
+		return readCDCSignature(r, magic)
+	}
+
 	var blockLen uint32
-	err = binary.Read(r, binary.BigEndian, &blockLen)
-	if err != nil {
+	if err := binary.Read(r, binary.BigEndian, &blockLen); err != nil {
 		return nil, err
 	}
-
 	var strongLen uint32
-	err = binary.Read(r, binary.BigEndian, &strongLen)
+	if err := binary.Read(r, binary.BigEndian, &strongLen); err != nil {
+		return nil, err
+	}
+
+	algo, err := lookupStrongHash(magic)
 	if err != nil {
 		return nil, err
 	}
 
+	var salt []byte
+	if algo.newKeyedFn != nil {
+		salt = make([]byte, SaltLength)
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return nil, err
+		}
+	}
+
 	strongSigs := [][]byte{}
-	weak2block := map[uint32]int{}
+	weakSums := []uint32{}
+	weak2block := map[uint32][]int{}
 
 	for {
 		var weakSum uint32
@@ -139,7 +175,8 @@ func ReadSignature(r io.Reader) (*SignatureType, error) {
 			return nil, fmt.Errorf("got only %d/%d bytes of the strong hash", n, strongLen)
 		}
 
-		weak2block[weakSum] = len(strongSigs)
+		weak2block[weakSum] = append(weak2block[weakSum], len(strongSigs))
+		weakSums = append(weakSums, weakSum)
 		strongSigs = append(strongSigs, strongSum)
 	}
 
@@ -147,11 +184,55 @@ func ReadSignature(r io.Reader) (*SignatureType, error) {
 		sigType:    magic,
 		blockLen:   blockLen,
 		strongLen:  strongLen,
+		strongHash: algo,
+		weakSums:   weakSums,
 		strongSigs: strongSigs,
 		weak2block: weak2block,
+		salt:       salt,
 	}, nil
 }
 
+// addBlock appends a (weak, strong) entry to the signature, chaining weak
+// onto any earlier blocks that share it so Lookup can disambiguate a
+// weak-sum collision by strong sum instead of only ever seeing one of them.
+func (s *SignatureType) addBlock(weak uint32, strong []byte) {
+	s.weak2block[weak] = append(s.weak2block[weak], len(s.strongSigs))
+	s.weakSums = append(s.weakSums, weak)
+	s.strongSigs = append(s.strongSigs, strong)
+}
+
+// BlockLen returns the block size used to build the signature.
+func (s *SignatureType) BlockLen() uint32 { return s.blockLen }
+
+// StrongLen returns the (possibly truncated) strong sum length used to
+// build the signature.
+func (s *SignatureType) StrongLen() uint32 { return s.strongLen }
+
+// Close is a no-op for an in-memory SignatureType; it exists so that
+// SignatureType satisfies SignatureIndex.
+func (s *SignatureType) Close() error { return nil }
+
+// Lookup implements SignatureIndex against the in-memory weak2block map and
+// strongSigs built by Signature or ReadSignature. When more than one block
+// shares weak, it returns the earliest one whose strong sum also matches,
+// the same tie-break diskSignatureIndex.Lookup applies via its probe chain.
+func (s *SignatureType) Lookup(weak uint32, strong []byte) (int, bool) {
+	for _, block := range s.weak2block[weak] {
+		if bytes.Equal(s.strongSigs[block], strong) {
+			return block, true
+		}
+	}
+	return 0, false
+}
+
+// SigType returns the magic number identifying the signature's wire format
+// and strong-hash algorithm.
+func (s *SignatureType) SigType() MagicNumber { return s.sigType }
+
+// Salt returns the per-signature key used with a keyed strong hash such as
+// BLAKE2_KEYED_SIG_MAGIC, or nil for an unsalted signature.
+func (s *SignatureType) Salt() []byte { return s.salt }
+
 // ReadSignatureFile reads a signature from the file at path.
 func ReadSignatureFile(path string) (*SignatureType, error) {
 	f, err := os.Open(path)
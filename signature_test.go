@@ -0,0 +1,28 @@
+package librsync
+
+import "testing"
+
+// TestSignatureTypeLookupResolvesWeakSumCollision builds a SignatureType
+// with two distinct blocks sharing a weak sum and checks that Lookup finds
+// the one whose strong sum actually matches, rather than only ever seeing
+// whichever block first claimed that weak sum.
+func TestSignatureTypeLookupResolvesWeakSumCollision(t *testing.T) {
+	sig := &SignatureType{weak2block: map[uint32][]int{}}
+	sig.addBlock(42, []byte("AAAA"))
+	sig.addBlock(99, []byte("BBBB"))
+	sig.addBlock(42, []byte("CCCC"))
+
+	block, ok := sig.Lookup(42, []byte("CCCC"))
+	if !ok || block != 2 {
+		t.Fatalf("Lookup(42, CCCC) = (%d, %v), want (2, true)", block, ok)
+	}
+
+	block, ok = sig.Lookup(42, []byte("AAAA"))
+	if !ok || block != 0 {
+		t.Fatalf("Lookup(42, AAAA) = (%d, %v), want (0, true)", block, ok)
+	}
+
+	if _, ok := sig.Lookup(42, []byte("ZZZZ")); ok {
+		t.Fatal("Lookup matched a strong sum that was never indexed under that weak sum")
+	}
+}
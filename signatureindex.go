@@ -0,0 +1,375 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+)
+
+// SignatureIndex is the lookup surface Delta needs from a signature: given a
+// candidate block's weak and strong sums, find the matching basis block, if
+// any. Signature and ReadSignature build an in-memory SignatureType, which
+// satisfies this interface directly; ReadSignatureIndexed additionally
+// supports a disk-backed implementation for basis files too large to index
+// in RAM.
+type SignatureIndex interface {
+	// Lookup returns the basis block index whose weak and strong sums match
+	// weak and strong, and whether a match was found.
+	Lookup(weak uint32, strong []byte) (block int, ok bool)
+	BlockLen() uint32
+	StrongLen() uint32
+
+	// SigType returns the magic number identifying the strong-hash
+	// algorithm the signature was built with, so Delta can compute a
+	// candidate block's strong sum the same way.
+	SigType() MagicNumber
+
+	// Salt returns the per-signature key used with a keyed strong hash, or
+	// nil for an unsalted signature.
+	Salt() []byte
+
+	Close() error
+}
+
+// IndexOptions controls how ReadSignatureIndexed builds a SignatureIndex.
+type IndexOptions struct {
+	// MaxRAM is the approximate number of bytes the index may occupy in
+	// memory. If the signature would exceed it, a disk-backed index is
+	// built instead of an in-memory one. Zero means unlimited.
+	MaxRAM int64
+
+	// FilterFPRate is the desired false-positive rate of the disk-backed
+	// index's weak-sum filter. Zero selects a default of 1%.
+	FilterFPRate float64
+
+	// ScratchDir is the directory the disk-backed index writes its hash
+	// table to. Empty uses os.TempDir.
+	ScratchDir string
+}
+
+func (o IndexOptions) fpRate() float64 {
+	if o.FilterFPRate <= 0 {
+		return 0.01
+	}
+	return o.FilterFPRate
+}
+
+func (o IndexOptions) scratchDir() string {
+	if o.ScratchDir == "" {
+		return os.TempDir()
+	}
+	return o.ScratchDir
+}
+
+// ReadSignatureIndexed reads the signature file at path and returns a
+// SignatureIndex over it, choosing an in-memory or disk-backed
+// implementation depending on opts.MaxRAM and the signature's size. Callers
+// must Close the returned index once done with it.
+//
+// The disk-backed path only understands the fixed-block wire format (with
+// or without the keyed-hash salt); CDC_SIG_MAGIC's variable-length chunks
+// are rejected rather than silently misread.
+func ReadSignatureIndexed(path string, opts IndexOptions) (SignatureIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readSignatureHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if header.magic == CDC_SIG_MAGIC {
+		f.Close()
+		return nil, fmt.Errorf("ReadSignatureIndexed: sigType %#x uses variable-length chunks and is not supported for disk-backed indexing; use ReadSignature instead", header.magic)
+	}
+
+	algo, err := lookupStrongHash(header.magic)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	dataStart, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var salt []byte
+	if algo.newKeyedFn != nil {
+		salt = make([]byte, SaltLength)
+		if _, err := io.ReadFull(f, salt); err != nil {
+			f.Close()
+			return nil, err
+		}
+		dataStart += SaltLength
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	entrySize := int64(header.strongLen) + 4
+	numEntries := (size - dataStart) / entrySize
+
+	if opts.MaxRAM > 0 && numEntries*entrySize > opts.MaxRAM {
+		return newDiskSignatureIndex(f, header, dataStart, numEntries, salt, opts)
+	}
+
+	f.Close()
+	sig, err := ReadSignatureFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// diskIndexSlotSize is the on-disk size of one diskSignatureIndex hash table
+// slot: a one-byte occupied flag, three bytes of padding, a four-byte weak
+// sum, and an eight-byte block index.
+const diskIndexSlotSize = 16
+
+// diskSignatureIndex indexes a signature file too large to hold in memory.
+// Only a compact open-addressing hash table of (weak sum -> block index)
+// and a Bloom filter over weak sums are kept around; strong sums are read
+// back from the signature file on demand, so misses rejected by the filter
+// never touch disk at all.
+type diskSignatureIndex struct {
+	sigFile   *os.File
+	dataStart int64
+	entrySize int64
+	blockLen  uint32
+	strongLen uint32
+	sigType   MagicNumber
+	salt      []byte
+
+	tableFile *os.File
+	capacity  int64
+	filter    *weakSumFilter
+}
+
+func newDiskSignatureIndex(sigFile *os.File, header signatureHeader, dataStart, numEntries int64, salt []byte, opts IndexOptions) (*diskSignatureIndex, error) {
+	capacity := nextPow2(numEntries*2 + 1) // ~50% load factor
+
+	tableFile, err := os.CreateTemp(opts.scratchDir(), "librsync-sigindex-*.tbl")
+	if err != nil {
+		sigFile.Close()
+		return nil, err
+	}
+	if err := tableFile.Truncate(capacity * diskIndexSlotSize); err != nil {
+		tableFile.Close()
+		os.Remove(tableFile.Name())
+		sigFile.Close()
+		return nil, err
+	}
+
+	idx := &diskSignatureIndex{
+		sigFile:   sigFile,
+		dataStart: dataStart,
+		entrySize: int64(header.strongLen) + 4,
+		blockLen:  header.blockLen,
+		strongLen: header.strongLen,
+		sigType:   header.magic,
+		salt:      salt,
+		tableFile: tableFile,
+		capacity:  capacity,
+		filter:    newWeakSumFilter(numEntries, opts.fpRate()),
+	}
+
+	if err := idx.build(); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *diskSignatureIndex) build() error {
+	if _, err := idx.sigFile.Seek(idx.dataStart, io.SeekStart); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(idx.sigFile)
+	strongBuf := make([]byte, idx.strongLen)
+	for block := int64(0); ; block++ {
+		var weak uint32
+		err := binary.Read(br, binary.BigEndian, &weak)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(br, strongBuf); err != nil {
+			return err
+		}
+
+		idx.filter.add(weak)
+		if err := idx.insert(weak, block); err != nil {
+			return err
+		}
+	}
+}
+
+type diskIndexSlot struct {
+	occupied bool
+	weak     uint32
+	block    int64
+}
+
+func (idx *diskSignatureIndex) readSlot(i int64) (diskIndexSlot, error) {
+	buf := make([]byte, diskIndexSlotSize)
+	if _, err := idx.tableFile.ReadAt(buf, i*diskIndexSlotSize); err != nil {
+		return diskIndexSlot{}, err
+	}
+	return diskIndexSlot{
+		occupied: buf[0] != 0,
+		weak:     binary.BigEndian.Uint32(buf[4:8]),
+		block:    int64(binary.BigEndian.Uint64(buf[8:16])),
+	}, nil
+}
+
+func (idx *diskSignatureIndex) writeSlot(i int64, s diskIndexSlot) error {
+	buf := make([]byte, diskIndexSlotSize)
+	if s.occupied {
+		buf[0] = 1
+	}
+	binary.BigEndian.PutUint32(buf[4:8], s.weak)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(s.block))
+	_, err := idx.tableFile.WriteAt(buf, i*diskIndexSlotSize)
+	return err
+}
+
+// insert records (weak, block) via linear probing. Entries that hash to the
+// same slot, including distinct blocks that share a weak sum, are chained
+// forward with no gaps, which Lookup relies on to stop at the first empty
+// slot.
+func (idx *diskSignatureIndex) insert(weak uint32, block int64) error {
+	i := int64(weak) % idx.capacity
+	for {
+		s, err := idx.readSlot(i)
+		if err != nil {
+			return err
+		}
+		if !s.occupied {
+			return idx.writeSlot(i, diskIndexSlot{occupied: true, weak: weak, block: block})
+		}
+		i = (i + 1) % idx.capacity
+	}
+}
+
+func (idx *diskSignatureIndex) Lookup(weak uint32, strong []byte) (int, bool) {
+	if !idx.filter.mayContain(weak) {
+		return 0, false
+	}
+
+	i := int64(weak) % idx.capacity
+	for {
+		s, err := idx.readSlot(i)
+		if err != nil || !s.occupied {
+			return 0, false
+		}
+		if s.weak == weak {
+			if ok, err := idx.strongMatches(s.block, strong); err == nil && ok {
+				return int(s.block), true
+			}
+		}
+		i = (i + 1) % idx.capacity
+	}
+}
+
+func (idx *diskSignatureIndex) strongMatches(block int64, strong []byte) (bool, error) {
+	buf := make([]byte, idx.strongLen)
+	off := idx.dataStart + block*idx.entrySize + 4
+	if _, err := idx.sigFile.ReadAt(buf, off); err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, strong), nil
+}
+
+func (idx *diskSignatureIndex) BlockLen() uint32     { return idx.blockLen }
+func (idx *diskSignatureIndex) StrongLen() uint32    { return idx.strongLen }
+func (idx *diskSignatureIndex) SigType() MagicNumber { return idx.sigType }
+func (idx *diskSignatureIndex) Salt() []byte         { return idx.salt }
+
+func (idx *diskSignatureIndex) Close() error {
+	name := idx.tableFile.Name()
+	tableErr := idx.tableFile.Close()
+	os.Remove(name)
+	sigErr := idx.sigFile.Close()
+	if tableErr != nil {
+		return tableErr
+	}
+	return sigErr
+}
+
+func nextPow2(n int64) int64 {
+	p := int64(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// weakSumFilter is a bitset-based Bloom filter over weak sums, sized for a
+// target false-positive rate. It lets diskSignatureIndex reject most
+// non-matching lookups without any disk I/O.
+type weakSumFilter struct {
+	bits []uint64
+	k    int
+}
+
+func newWeakSumFilter(n int64, fpRate float64) *weakSumFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := int64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &weakSumFilter{bits: make([]uint64, (m+63)/64), k: k}
+}
+
+func (f *weakSumFilter) nbits() uint64 { return uint64(len(f.bits)) * 64 }
+
+func (f *weakSumFilter) hashes(weak uint32) (uint64, uint64) {
+	h := fnv.New64a()
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], weak)
+	h.Write(b[:])
+	h1 := h.Sum64()
+	h.Write(b[:])
+	h2 := h.Sum64()
+	return h1, h2
+}
+
+func (f *weakSumFilter) add(weak uint32) {
+	h1, h2 := f.hashes(weak)
+	n := f.nbits()
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint64(i)*h2) % n
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (f *weakSumFilter) mayContain(weak uint32) bool {
+	h1, h2 := f.hashes(weak)
+	n := f.nbits()
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint64(i)*h2) % n
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
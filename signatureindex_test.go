@@ -0,0 +1,132 @@
+package librsync
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeTempSignature(t *testing.T, build func(out *os.File) error) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "sig-*.rdiff")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer f.Close()
+	if err := build(f); err != nil {
+		t.Fatalf("building signature: %v", err)
+	}
+	return f.Name()
+}
+
+// testIndexRoundTrip builds a fixed-block signature over known content using
+// build, then checks that ReadSignatureIndexed agrees between its in-memory
+// path (MaxRAM: 0) and its disk-backed path (MaxRAM forced to 1 byte) for
+// every block, and that both correctly reject a sum that isn't present.
+//
+// The fixture content repeats, so a given (weak, strong) pair can legitimately
+// match more than one block; both SignatureIndex implementations resolve
+// that to the earliest block sharing the pair, which need not be the block
+// whose sums are being looked up. The test therefore checks
+// that mem and disk agree with each other and that whichever block they
+// return really does carry the looked-up sums, rather than asserting the
+// returned block equals the original loop index.
+func testIndexRoundTrip(t *testing.T, magic MagicNumber, blockLen uint32, build func(input *strings.Reader, out *os.File) (*SignatureType, error)) {
+	t.Helper()
+
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog ", 50)
+	var built *SignatureType
+	path := writeTempSignature(t, func(out *os.File) error {
+		var err error
+		built, err = build(strings.NewReader(content), out)
+		return err
+	})
+
+	mem, err := ReadSignatureIndexed(path, IndexOptions{})
+	if err != nil {
+		t.Fatalf("ReadSignatureIndexed (in-memory): %v", err)
+	}
+	defer mem.Close()
+
+	disk, err := ReadSignatureIndexed(path, IndexOptions{MaxRAM: 1})
+	if err != nil {
+		t.Fatalf("ReadSignatureIndexed (disk-backed): %v", err)
+	}
+	defer disk.Close()
+
+	if mem.BlockLen() != disk.BlockLen() || mem.StrongLen() != disk.StrongLen() {
+		t.Fatalf("in-memory and disk-backed index disagree on header: (%d,%d) vs (%d,%d)",
+			mem.BlockLen(), mem.StrongLen(), disk.BlockLen(), disk.StrongLen())
+	}
+	if mem.SigType() != magic || disk.SigType() != magic {
+		t.Fatalf("SigType() = (mem %#x, disk %#x), want %#x", mem.SigType(), disk.SigType(), magic)
+	}
+	if mem.BlockLen() != blockLen {
+		t.Fatalf("BlockLen() = %d, want %d", mem.BlockLen(), blockLen)
+	}
+
+	for i, weak := range built.weakSums {
+		strong := built.strongSigs[i]
+
+		memBlock, memOK := mem.Lookup(weak, strong)
+		diskBlock, diskOK := disk.Lookup(weak, strong)
+		if !memOK || !diskOK {
+			t.Fatalf("block %d: Lookup failed (mem ok=%v, disk ok=%v)", i, memOK, diskOK)
+		}
+		if memBlock != diskBlock {
+			t.Fatalf("block %d: in-memory and disk-backed index disagree: mem=%d disk=%d", i, memBlock, diskBlock)
+		}
+		if built.weakSums[memBlock] != weak || !bytes.Equal(built.strongSigs[memBlock], strong) {
+			t.Fatalf("block %d: Lookup returned block %d, whose sums don't match", i, memBlock)
+		}
+	}
+
+	if _, ok := mem.Lookup(0xdeadbeef, bytes.Repeat([]byte{0xff}, int(mem.StrongLen()))); ok {
+		t.Fatal("in-memory index matched a sum that was never indexed")
+	}
+	if _, ok := disk.Lookup(0xdeadbeef, bytes.Repeat([]byte{0xff}, int(disk.StrongLen()))); ok {
+		t.Fatal("disk-backed index matched a sum that was never indexed")
+	}
+}
+
+func TestReadSignatureIndexedBlake2(t *testing.T) {
+	testIndexRoundTrip(t, BLAKE2_SIG_MAGIC, 8, func(input *strings.Reader, out *os.File) (*SignatureType, error) {
+		return Signature(input, out, 8, BLAKE2_SUM_LENGTH, BLAKE2_SIG_MAGIC)
+	})
+}
+
+func TestReadSignatureIndexedMD4(t *testing.T) {
+	testIndexRoundTrip(t, MD4_SIG_MAGIC, 8, func(input *strings.Reader, out *os.File) (*SignatureType, error) {
+		return Signature(input, out, 8, MD4_SUM_LENGTH, MD4_SIG_MAGIC)
+	})
+}
+
+func TestReadSignatureIndexedSHA256(t *testing.T) {
+	testIndexRoundTrip(t, SHA256_SIG_MAGIC, 8, func(input *strings.Reader, out *os.File) (*SignatureType, error) {
+		return Signature(input, out, 8, SHA256_SUM_LENGTH, SHA256_SIG_MAGIC)
+	})
+}
+
+func TestReadSignatureIndexedBlake2Keyed(t *testing.T) {
+	testIndexRoundTrip(t, BLAKE2_KEYED_SIG_MAGIC, 8, func(input *strings.Reader, out *os.File) (*SignatureType, error) {
+		return SignatureWithOptions(input, out, 8, BLAKE2_SUM_LENGTH, BLAKE2_KEYED_SIG_MAGIC, SignatureOptions{GenerateSalt: true})
+	})
+}
+
+func TestReadSignatureIndexedRejectsCDC(t *testing.T) {
+	path := writeTempSignature(t, func(out *os.File) error {
+		_, err := SignatureCDC(strings.NewReader(strings.Repeat("abcdefgh", 200)), out, CDCOptions{AvgSize: 32, MinSize: 8, MaxSize: 128}, BLAKE2_SUM_LENGTH)
+		return err
+	})
+
+	if _, err := ReadSignatureIndexed(path, IndexOptions{MaxRAM: 1}); err == nil {
+		t.Fatal("ReadSignatureIndexed should reject a CDC_SIG_MAGIC signature when forced to the disk-backed path")
+	}
+
+	// The in-memory path is also expected to reject it today: ReadSignatureIndexed
+	// rejects CDC_SIG_MAGIC outright rather than silently misreading it.
+	if _, err := ReadSignatureIndexed(path, IndexOptions{}); err == nil {
+		t.Fatal("ReadSignatureIndexed should reject a CDC_SIG_MAGIC signature")
+	}
+}
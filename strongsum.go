@@ -0,0 +1,105 @@
+package librsync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// SHA256_SIG_MAGIC identifies a signature using a truncated SHA-256 strong
+// sum. It is a librsync-go extension and is not understood by upstream
+// librsync.
+const SHA256_SIG_MAGIC MagicNumber = 0x72730140
+
+const SHA256_SUM_LENGTH = sha256.Size
+
+// strongHashAlgo describes a strong-hash algorithm registered under a
+// MagicNumber, mirroring how the standard library's crypto.Hash resolves to
+// a concrete hash.Hash implementation. Exactly one of newFn and newKeyedFn
+// is set: a keyed algorithm must be given a per-signature salt before it can
+// be used, and unsalted code paths reject it.
+type strongHashAlgo struct {
+	name       string
+	maxLen     uint32
+	newFn      func() hash.Hash
+	newKeyedFn func(key []byte) (hash.Hash, error)
+}
+
+var strongHashRegistry = map[MagicNumber]strongHashAlgo{}
+
+// RegisterStrongHash registers a strong-hash algorithm under magic so that
+// Signature, ReadSignature and CalcStrongSum can produce and consume it.
+// Third-party packages can call this from an init function to add support
+// for additional algorithms without modifying librsync-go itself.
+func RegisterStrongHash(magic MagicNumber, name string, maxLen uint32, newFn func() hash.Hash) {
+	strongHashRegistry[magic] = strongHashAlgo{name: name, maxLen: maxLen, newFn: newFn}
+}
+
+// RegisterKeyedStrongHash registers a strong-hash algorithm, under magic,
+// that must be keyed with a per-signature salt before use. Signature and
+// ReadSignature reject magic unless a salt is supplied, so that a salted
+// signature can never be mistaken for an unsalted one.
+func RegisterKeyedStrongHash(magic MagicNumber, name string, maxLen uint32, newKeyedFn func(key []byte) (hash.Hash, error)) {
+	strongHashRegistry[magic] = strongHashAlgo{name: name, maxLen: maxLen, newKeyedFn: newKeyedFn}
+}
+
+func init() {
+	RegisterStrongHash(BLAKE2_SIG_MAGIC, "blake2b-256", BLAKE2_SUM_LENGTH, func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	})
+	RegisterStrongHash(MD4_SIG_MAGIC, "md4", MD4_SUM_LENGTH, md4.New)
+	RegisterStrongHash(SHA256_SIG_MAGIC, "sha256", SHA256_SUM_LENGTH, sha256.New)
+}
+
+// lookupStrongHash returns the algorithm registered for sigType, or an error
+// if sigType is not a known strong-hash magic number.
+func lookupStrongHash(sigType MagicNumber) (strongHashAlgo, error) {
+	algo, ok := strongHashRegistry[sigType]
+	if !ok {
+		return strongHashAlgo{}, fmt.Errorf("invalid sigType %#x", sigType)
+	}
+	return algo, nil
+}
+
+// CalcStrongSum computes the unsalted strong sum of data under sigType.
+// Keyed algorithms such as BLAKE2_KEYED_SIG_MAGIC have no unsalted form and
+// are rejected; use calcStrongSum with a salt instead.
+func CalcStrongSum(data []byte, sigType MagicNumber, strongLen uint32) ([]byte, error) {
+	algo, err := lookupStrongHash(sigType)
+	if err != nil {
+		return nil, err
+	}
+	return calcStrongSum(data, algo, strongLen, nil)
+}
+
+// calcStrongSum computes the strong sum of data using algo, keying it with
+// salt when algo is a keyed algorithm.
+func calcStrongSum(data []byte, algo strongHashAlgo, strongLen uint32, salt []byte) ([]byte, error) {
+	if strongLen > algo.maxLen {
+		return nil, fmt.Errorf("invalid strongLen %d for sigType %s", strongLen, algo.name)
+	}
+
+	if algo.newKeyedFn != nil {
+		if len(salt) == 0 {
+			return nil, fmt.Errorf("sigType %s requires a salt", algo.name)
+		}
+		h, err := algo.newKeyedFn(salt)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(data)
+		return h.Sum(nil)[:strongLen], nil
+	}
+
+	if len(salt) != 0 {
+		return nil, fmt.Errorf("sigType %s does not support a salt", algo.name)
+	}
+
+	h := algo.newFn()
+	h.Write(data)
+	return h.Sum(nil)[:strongLen], nil
+}
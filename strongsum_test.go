@@ -0,0 +1,51 @@
+package librsync
+
+import "testing"
+
+func TestCalcStrongSumRegisteredMagics(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, magic := range []MagicNumber{BLAKE2_SIG_MAGIC, MD4_SIG_MAGIC, SHA256_SIG_MAGIC} {
+		algo, err := lookupStrongHash(magic)
+		if err != nil {
+			t.Fatalf("lookupStrongHash(%#x): %v", magic, err)
+		}
+
+		sum, err := CalcStrongSum(data, magic, algo.maxLen)
+		if err != nil {
+			t.Fatalf("CalcStrongSum(%#x): %v", magic, err)
+		}
+		if uint32(len(sum)) != algo.maxLen {
+			t.Fatalf("CalcStrongSum(%#x): got %d bytes, want %d", magic, len(sum), algo.maxLen)
+		}
+
+		again, err := CalcStrongSum(data, magic, algo.maxLen)
+		if err != nil || string(again) != string(sum) {
+			t.Fatalf("CalcStrongSum(%#x) is not deterministic", magic)
+		}
+	}
+}
+
+func TestCalcStrongSumRejectsOversizeStrongLen(t *testing.T) {
+	algo, err := lookupStrongHash(BLAKE2_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("lookupStrongHash: %v", err)
+	}
+
+	_, err = CalcStrongSum([]byte("data"), BLAKE2_SIG_MAGIC, algo.maxLen+1)
+	if err == nil {
+		t.Fatal("CalcStrongSum should reject a strongLen larger than the algorithm's digest size")
+	}
+}
+
+func TestCalcStrongSumRejectsKeyedWithoutSalt(t *testing.T) {
+	algo, err := lookupStrongHash(BLAKE2_KEYED_SIG_MAGIC)
+	if err != nil {
+		t.Fatalf("lookupStrongHash: %v", err)
+	}
+
+	_, err = CalcStrongSum([]byte("data"), BLAKE2_KEYED_SIG_MAGIC, algo.maxLen)
+	if err == nil {
+		t.Fatal("CalcStrongSum should reject a keyed sigType with no salt")
+	}
+}